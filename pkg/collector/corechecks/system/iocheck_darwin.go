@@ -0,0 +1,22 @@
+// +build darwin
+
+package system
+
+import (
+	"time"
+
+	"github.com/shirou/gopsutil/disk"
+)
+
+// darwinSupportedMetrics lists the metrics gopsutil's IOKit-backed darwin
+// counters can populate. IOKit only exposes counts, bytes and cumulative
+// time per device, so merge counts, queue size, svctm and util aren't
+// available the way they are on Linux.
+const darwinSupportedMetrics = metricRS | metricWS | metricRKbS | metricWKbS |
+	metricAvgRqSz | metricAwait | metricRAwait | metricWAwait
+
+func init() {
+	computeIOMetrics = func(prev, cur disk.IOCountersStat, elapsed time.Duration) ioMetrics {
+		return computeIOMetricsGeneric(darwinSupportedMetrics, prev, cur, elapsed)
+	}
+}
@@ -0,0 +1,21 @@
+// +build freebsd
+
+package system
+
+import (
+	"time"
+
+	"github.com/shirou/gopsutil/disk"
+)
+
+// freebsdSupportedMetrics lists the metrics gopsutil's devstat-backed
+// FreeBSD counters can populate. Like darwin, FreeBSD exposes counts, bytes
+// and cumulative time per device but no merge counts or queue depth.
+const freebsdSupportedMetrics = metricRS | metricWS | metricRKbS | metricWKbS |
+	metricAvgRqSz | metricAwait | metricRAwait | metricWAwait
+
+func init() {
+	computeIOMetrics = func(prev, cur disk.IOCountersStat, elapsed time.Duration) ioMetrics {
+		return computeIOMetricsGeneric(freebsdSupportedMetrics, prev, cur, elapsed)
+	}
+}
@@ -0,0 +1,46 @@
+// +build windows darwin freebsd
+
+package system
+
+import (
+	"time"
+
+	"github.com/shirou/gopsutil/disk"
+)
+
+// computeIOMetricsGeneric implements the math shared by every platform whose
+// gopsutil backend only exposes per-device counts, bytes and cumulative time
+// (Windows' PDH counters, Darwin's IOKit counters, FreeBSD's devstat
+// counters) as opposed to Linux's /proc/diskstats, which additionally
+// exposes merge counts and queue depth (see iocheck_linux.go). supported is
+// the per-platform ioMetric bitmask to stamp onto the result.
+func computeIOMetricsGeneric(supported ioMetric, prev, cur disk.IOCountersStat, elapsed time.Duration) ioMetrics {
+	m := ioMetrics{supported: supported}
+
+	elapsedSec := elapsed.Seconds()
+	if elapsedSec == 0 {
+		return m
+	}
+
+	diffNRIO := float64(cur.ReadCount - prev.ReadCount)
+	diffNWIO := float64(cur.WriteCount - prev.WriteCount)
+	diffNIO := diffNRIO + diffNWIO
+
+	m.rS = diffNRIO / elapsedSec
+	m.wS = diffNWIO / elapsedSec
+	m.rKbS = float64(cur.ReadBytes-prev.ReadBytes) / kB / elapsedSec
+	m.wKbS = float64(cur.WriteBytes-prev.WriteBytes) / kB / elapsedSec
+
+	if diffNRIO != 0 {
+		m.rAwait = float64(cur.ReadTime-prev.ReadTime) / diffNRIO
+	}
+	if diffNWIO != 0 {
+		m.wAwait = float64(cur.WriteTime-prev.WriteTime) / diffNWIO
+	}
+	if diffNIO != 0 {
+		m.avgRqSz = float64((cur.ReadBytes-prev.ReadBytes+cur.WriteBytes-prev.WriteBytes)/SectorSize) / diffNIO
+		m.await = float64(cur.ReadTime-prev.ReadTime+cur.WriteTime-prev.WriteTime) / diffNIO
+	}
+
+	return m
+}
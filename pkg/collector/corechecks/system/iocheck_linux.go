@@ -0,0 +1,81 @@
+// +build linux
+
+package system
+
+import (
+	"time"
+
+	"github.com/shirou/gopsutil/disk"
+)
+
+/*
+#include <unistd.h>
+#include <sys/types.h>
+#include <pwd.h>
+#include <stdlib.h>
+*/
+import "C"
+
+// kernel ticks / sec, used to convert svctm's throughput term from a count
+// of intervals to a per-second rate.
+var hz = uint64(C.sysconf(C._SC_CLK_TCK))
+
+// linuxSupportedMetrics lists every metric Linux's /proc/diskstats-backed
+// counters can populate.
+const linuxSupportedMetrics = metricRRqmS | metricWRqmS | metricRS | metricWS |
+	metricRKbS | metricWKbS | metricAvgRqSz | metricAvgQuSz | metricAwait |
+	metricRAwait | metricWAwait | metricSvctm | metricUtil
+
+func init() {
+	computeIOMetrics = computeIOMetricsLinux
+}
+
+// computeIOMetricsLinux mirrors the math iostat(1) performs on the raw
+// /proc/diskstats counters.
+// See: https://www.xaprb.com/blog/2010/01/09/how-linux-iostat-computes-its-results/
+//      https://www.kernel.org/doc/Documentation/iostats.txt
+func computeIOMetricsLinux(prev, cur disk.IOCountersStat, elapsed time.Duration) ioMetrics {
+	m := ioMetrics{supported: linuxSupportedMetrics}
+
+	elapsedSec := elapsed.Seconds()
+	if elapsedSec == 0 {
+		return m
+	}
+
+	diffNRIO := float64(cur.ReadCount - prev.ReadCount)
+	diffNWIO := float64(cur.WriteCount - prev.WriteCount)
+	diffNIO := diffNRIO + diffNWIO
+
+	m.rRqmS = float64(cur.MergedReadCount-prev.MergedReadCount) / elapsedSec
+	m.wRqmS = float64(cur.MergedWriteCount-prev.MergedWriteCount) / elapsedSec
+	m.rS = diffNRIO / elapsedSec
+	m.wS = diffNWIO / elapsedSec
+	m.rKbS = float64(cur.ReadBytes-prev.ReadBytes) / kB / elapsedSec
+	m.wKbS = float64(cur.WriteBytes-prev.WriteBytes) / kB / elapsedSec
+	m.avgQuSz = float64(cur.WeightedIO-prev.WeightedIO) / 1000 / elapsedSec
+
+	if diffNRIO != 0 {
+		m.rAwait = float64(cur.ReadTime-prev.ReadTime) / diffNRIO
+	}
+	if diffNWIO != 0 {
+		m.wAwait = float64(cur.WriteTime-prev.WriteTime) / diffNWIO
+	}
+
+	if diffNIO != 0 {
+		m.avgRqSz = float64((cur.ReadBytes-prev.ReadBytes+cur.WriteBytes-prev.WriteBytes)/SectorSize) / diffNIO
+		m.await = float64(cur.ReadTime-prev.ReadTime+cur.WriteTime-prev.WriteTime) / diffNIO
+	}
+
+	tput := diffNIO * float64(hz)
+	util := float64(cur.IoTime - prev.IoTime)
+	if tput != 0 {
+		m.svctm = util / tput
+	}
+
+	// Stats should be per device no device groups.
+	// If device groups ever become a thing - util / 10.0 / n_devs_in_group
+	// See more: (https://github.com/sysstat/sysstat/blob/v11.5.6/iostat.c#L1033-L1040)
+	m.util = (util / 10.0) / elapsedSec
+
+	return m
+}
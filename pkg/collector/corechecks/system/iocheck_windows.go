@@ -0,0 +1,22 @@
+// +build windows
+
+package system
+
+import (
+	"time"
+
+	"github.com/shirou/gopsutil/disk"
+)
+
+// windowsSupportedMetrics lists the metrics gopsutil's PDH-backed Windows
+// counters can populate. Windows has no notion of request merging or queue
+// depth in the same sense as Linux's /proc/diskstats, so rrqm_s, wrqm_s,
+// avg_q_sz, svctm and util are left unsupported.
+const windowsSupportedMetrics = metricRS | metricWS | metricRKbS | metricWKbS |
+	metricAvgRqSz | metricAwait | metricRAwait | metricWAwait
+
+func init() {
+	computeIOMetrics = func(prev, cur disk.IOCountersStat, elapsed time.Duration) ioMetrics {
+		return computeIOMetricsGeneric(windowsSupportedMetrics, prev, cur, elapsed)
+	}
+}
@@ -2,39 +2,105 @@ package system
 
 import (
 	"bytes"
+	"regexp"
 	"time"
 
 	"github.com/DataDog/datadog-agent/pkg/collector/check"
 	core "github.com/DataDog/datadog-agent/pkg/collector/corechecks"
 	log "github.com/cihub/seelog"
 	"github.com/shirou/gopsutil/disk"
+	yaml "gopkg.in/yaml.v2"
 
 	"github.com/DataDog/datadog-agent/pkg/aggregator"
 )
 
-/*
-#include <unistd.h>
-#include <sys/types.h>
-#include <pwd.h>
-#include <stdlib.h>
-*/
-import "C"
-
 // For testing purpose
 var ioCounters = disk.IOCounters
 
-// kernel ticks / sec
-var hz uint64
-
 const (
 	// SectorSize is exported in github.com/shirou/gopsutil/disk (but not working!)
 	SectorSize = 512
 	kB         = 1024
 )
 
-// IOCheck doesn't need additional fields
+// ioMetric identifies one of the gauges this check can emit. Backends report
+// which of these they're able to populate on their platform, so Run only
+// submits metrics that are actually meaningful there.
+type ioMetric uint16
+
+const (
+	metricRRqmS ioMetric = 1 << iota
+	metricWRqmS
+	metricRS
+	metricWS
+	metricRKbS
+	metricWKbS
+	metricAvgRqSz
+	metricAvgQuSz
+	metricAwait
+	metricRAwait
+	metricWAwait
+	metricSvctm
+	metricUtil
+)
+
+// ioMetrics holds the computed per-device IO metrics for one collection
+// interval, plus the set of metrics the platform backend was able to compute.
+type ioMetrics struct {
+	supported ioMetric
+
+	rRqmS, wRqmS          float64
+	rS, wS                float64
+	rKbS, wKbS            float64
+	avgRqSz, avgQuSz      float64
+	await, rAwait, wAwait float64
+	svctm, util           float64
+}
+
+// computeIOMetrics is implemented per-OS (see iocheck_linux.go,
+// iocheck_windows.go, iocheck_darwin.go) since the gopsutil counters it's
+// fed are only meaningful for a subset of fields on any given platform.
+var computeIOMetrics func(prev, cur disk.IOCountersStat, elapsed time.Duration) ioMetrics
+
+// ioConfig holds the instance configuration for the io check
+type ioConfig struct {
+	DeviceBlacklist []string `yaml:"device_blacklist"`
+	DeviceInclude   []string `yaml:"device_include"`
+}
+
+// IOCheck tracks the devices excluded/included via config and the compiled
+// regexes used to filter them out in Run, along with the counters from the
+// previous run so rates can be computed against the actual elapsed time
+// between scheduler ticks rather than a fixed sleep.
 type IOCheck struct {
 	sender aggregator.Sender
+
+	blacklistRe []*regexp.Regexp
+	includeRe   []*regexp.Regexp
+
+	lastCounters map[string]disk.IOCountersStat
+	lastRunTime  time.Time
+}
+
+// excluded returns true if the device should be skipped: it's either matched
+// by the blacklist, or an include list is set and the device doesn't match it
+func (c *IOCheck) excluded(device string) bool {
+	for _, re := range c.blacklistRe {
+		if re.MatchString(device) {
+			return true
+		}
+	}
+
+	if len(c.includeRe) == 0 {
+		return false
+	}
+
+	for _, re := range c.includeRe {
+		if re.MatchString(device) {
+			return false
+		}
+	}
+	return true
 }
 
 func (c *IOCheck) String() string {
@@ -49,91 +115,111 @@ func (c *IOCheck) Run() error {
 		return err
 	}
 
-	//sleep and collect again
-	time.Sleep(time.Second)
-	iomap2, err := ioCounters()
-	if err != nil {
-		log.Errorf("system.IOCheck: could not retrieve io stats: %s", err)
-		return err
+	now := time.Now()
+	if c.lastCounters == nil {
+		// First run: prime the state and wait for the next tick to emit rates.
+		c.lastCounters = iomap
+		c.lastRunTime = now
+		return nil
 	}
+	elapsed := now.Sub(c.lastRunTime)
 
 	for device, ioStats := range iomap {
-		ioStats2, ok := iomap2[device]
+		if c.excluded(device) {
+			continue
+		}
+
+		prevStats, ok := c.lastCounters[device]
 		if !ok {
 			log.Infof("New device stats (possible hotplug) - full stats unavailable this iteration.")
 			continue
 		}
 
+		m := computeIOMetrics(prevStats, ioStats, elapsed)
+
 		var tagbuff bytes.Buffer
 		tagbuff.WriteString("device:")
 		tagbuff.WriteString(device)
+		tags := []string{tagbuff.String()}
 
-		// TODO: Different OS have different fields.... account for that
-		// See: https://www.xaprb.com/blog/2010/01/09/how-linux-iostat-computes-its-results/
-		//      https://www.kernel.org/doc/Documentation/iostats.txt
-		// Linux
-		rrqms := (ioStats2.MergedReadCount - ioStats.MergedReadCount)
-		wrqms := (ioStats2.MergedWriteCount - ioStats.MergedWriteCount)
-		rs := (ioStats2.ReadCount - ioStats.ReadCount)
-		ws := (ioStats2.WriteCount - ioStats.WriteCount)
-		rkbs := float64(ioStats2.ReadBytes-ioStats.ReadBytes) / kB
-		wkbs := float64(ioStats2.WriteBytes-ioStats.WriteBytes) / kB
-		avgqusz := float64(ioStats2.WeightedIO-ioStats.WeightedIO) / 1000
-
-		rAwait := 0.0
-		wAwait := 0.0
-		diffNRIO := float64(ioStats2.ReadCount - ioStats.ReadCount)
-		diffNWIO := float64(ioStats2.WriteCount - ioStats.WriteCount)
-		if diffNRIO != 0 {
-			rAwait = float64(ioStats2.ReadTime-ioStats.ReadTime) / diffNRIO
+		if m.supported&metricRRqmS != 0 {
+			c.sender.Gauge("system.io.rrqm_s", m.rRqmS, "", tags)
 		}
-		if diffNWIO != 0 {
-			wAwait = float64(ioStats2.WriteTime-ioStats.WriteTime) / diffNWIO
+		if m.supported&metricWRqmS != 0 {
+			c.sender.Gauge("system.io.wrqm_s", m.wRqmS, "", tags)
 		}
-
-		avgrqsz := 0.0
-		await := 0.0
-		svctime := 0.0
-
-		diffNIO := float64(diffNRIO + diffNWIO)
-		if diffNIO != 0 {
-			avgrqsz = float64((ioStats2.ReadBytes-ioStats.ReadBytes+ioStats2.WriteBytes-ioStats.WriteBytes)/SectorSize) / diffNIO
-			await = float64(ioStats2.ReadTime-ioStats.ReadTime+ioStats2.WriteTime-ioStats.WriteTime) / diffNIO
+		if m.supported&metricRS != 0 {
+			c.sender.Gauge("system.io.r_s", m.rS, "", tags)
+		}
+		if m.supported&metricWS != 0 {
+			c.sender.Gauge("system.io.w_s", m.wS, "", tags)
+		}
+		if m.supported&metricRKbS != 0 {
+			c.sender.Gauge("system.io.rkb_s", m.rKbS, "", tags)
+		}
+		if m.supported&metricWKbS != 0 {
+			c.sender.Gauge("system.io.wkb_s", m.wKbS, "", tags)
 		}
-		tput := diffNIO * float64(hz)
-		util := float64(ioStats2.IoTime - ioStats.IoTime)
-		if tput != 0 {
-			svctime = util / tput
+		if m.supported&metricAvgRqSz != 0 {
+			c.sender.Gauge("system.io.avg_rq_sz", m.avgRqSz, "", tags)
+		}
+		if m.supported&metricAvgQuSz != 0 {
+			c.sender.Gauge("system.io.avg_q_sz", m.avgQuSz, "", tags)
+		}
+		if m.supported&metricAwait != 0 {
+			c.sender.Gauge("system.io.await", m.await, "", tags)
+		}
+		if m.supported&metricRAwait != 0 {
+			c.sender.Gauge("system.io.r_await", m.rAwait, "", tags)
+		}
+		if m.supported&metricWAwait != 0 {
+			c.sender.Gauge("system.io.w_await", m.wAwait, "", tags)
+		}
+		if m.supported&metricSvctm != 0 {
+			c.sender.Gauge("system.io.svctm", m.svctm, "", tags)
+		}
+		if m.supported&metricUtil != 0 {
+			// Stats should be per device no device groups.
+			// If device groups ever become a thing - util / 10.0 / n_devs_in_group
+			// See more: (https://github.com/sysstat/sysstat/blob/v11.5.6/iostat.c#L1033-L1040)
+			c.sender.Gauge("system.io.util", m.util, "", tags)
 		}
 
-		tags := []string{tagbuff.String()}
-		c.sender.Gauge("system.io.rrqm_s", float64(rrqms), "", tags)
-		c.sender.Gauge("system.io.wrqm_s", float64(wrqms), "", tags)
-		c.sender.Gauge("system.io.r_s", float64(rs), "", tags)
-		c.sender.Gauge("system.io.w_s", float64(ws), "", tags)
-		c.sender.Gauge("system.io.rkb_s", rkbs, "", tags)
-		c.sender.Gauge("system.io.wkb_s", wkbs, "", tags)
-		c.sender.Gauge("system.io.avg_rq_sz", avgrqsz, "", tags)
-		c.sender.Gauge("system.io.avg_q_sz", avgqusz, "", tags)
-		c.sender.Gauge("system.io.await", await, "", tags)
-		c.sender.Gauge("system.io.r_await", float64(rAwait), "", tags)
-		c.sender.Gauge("system.io.w_await", float64(wAwait), "", tags)
-		c.sender.Gauge("system.io.svctm", svctime, "", tags)
-
-		// Stats should be per device no device groups.
-		// If device groups ever become a thing - util / 10.0 / n_devs_in_group
-		// See more: (https://github.com/sysstat/sysstat/blob/v11.5.6/iostat.c#L1033-L1040)
-		c.sender.Gauge("system.io.util", (util / 10.0), "", tags)
-
-		// TODO: enable blacklist
 		c.sender.Commit()
 	}
 
+	c.lastCounters = iomap
+	c.lastRunTime = now
+
 	return nil
 }
 
-// Configure the CPU check doesn't need configuration
+// Configure parses the instance config, compiling the device_blacklist and
+// device_include patterns once so Run only has to match against them
 func (c *IOCheck) Configure(data check.ConfigData, initConfig check.ConfigData) error {
+	conf := ioConfig{}
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return err
+	}
+
+	for _, pattern := range conf.DeviceBlacklist {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Errorf("system.IOCheck: invalid device_blacklist pattern %q: %s", pattern, err)
+			continue
+		}
+		c.blacklistRe = append(c.blacklistRe, re)
+	}
+
+	for _, pattern := range conf.DeviceInclude {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Errorf("system.IOCheck: invalid device_include pattern %q: %s", pattern, err)
+			continue
+		}
+		c.includeRe = append(c.includeRe, re)
+	}
+
 	return nil
 }
 
@@ -167,10 +253,4 @@ func ioFactory() check.Check {
 
 func init() {
 	core.RegisterCheck("io", ioFactory)
-
-	// get the clock frequency - one time op
-	var scClkTck C.long
-	scClkTck = C.sysconf(C._SC_CLK_TCK)
-
-	hz = uint64(scClkTck)
 }
@@ -0,0 +1,91 @@
+package system
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/shirou/gopsutil/disk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIOCheckExcluded(t *testing.T) {
+	tests := []struct {
+		desc        string
+		blacklist   []string
+		include     []string
+		device      string
+		wantExclude bool
+	}{
+		{"no filters", nil, nil, "sda", false},
+		{"blacklisted", []string{"^sda$"}, nil, "sda", true},
+		{"not blacklisted", []string{"^sda$"}, nil, "sdb", false},
+		{"not in include list", nil, []string{"^sda$"}, "sdb", true},
+		{"in include list", nil, []string{"^sda$"}, "sda", false},
+		{"blacklist wins over include", []string{"^sda$"}, []string{"^sda$"}, "sda", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			c := &IOCheck{}
+			for _, pattern := range tt.blacklist {
+				c.blacklistRe = append(c.blacklistRe, mustCompile(t, pattern))
+			}
+			for _, pattern := range tt.include {
+				c.includeRe = append(c.includeRe, mustCompile(t, pattern))
+			}
+
+			assert.Equal(t, tt.wantExclude, c.excluded(tt.device))
+		})
+	}
+}
+
+// TestIOCheckRunFirstRunPrimesState verifies that the first call to Run only
+// primes lastCounters/lastRunTime from the ioCounters hook and never emits,
+// since there's no previous sample yet to diff against.
+func TestIOCheckRunFirstRunPrimesState(t *testing.T) {
+	defer func(orig func() (map[string]disk.IOCountersStat, error)) { ioCounters = orig }(ioCounters)
+
+	sda := disk.IOCountersStat{ReadCount: 10, WriteCount: 5}
+	ioCounters = func() (map[string]disk.IOCountersStat, error) {
+		return map[string]disk.IOCountersStat{"sda": sda}, nil
+	}
+
+	c := &IOCheck{}
+
+	assert.Nil(t, c.lastCounters)
+	assert.NoError(t, c.Run())
+	assert.Equal(t, map[string]disk.IOCountersStat{"sda": sda}, c.lastCounters)
+	assert.False(t, c.lastRunTime.IsZero())
+}
+
+// TestIOCheckRunSkipsExcludedDevices verifies that on a subsequent run, a
+// device matched by the blacklist is skipped before computeIOMetrics (and
+// therefore the sender) is ever reached, while lastCounters is still
+// refreshed to the latest sample from ioCounters.
+func TestIOCheckRunSkipsExcludedDevices(t *testing.T) {
+	defer func(orig func() (map[string]disk.IOCountersStat, error)) { ioCounters = orig }(ioCounters)
+
+	loop0 := disk.IOCountersStat{ReadCount: 1, WriteCount: 1}
+	ioCounters = func() (map[string]disk.IOCountersStat, error) {
+		return map[string]disk.IOCountersStat{"loop0": loop0}, nil
+	}
+
+	c := &IOCheck{
+		blacklistRe:  []*regexp.Regexp{mustCompile(t, "^loop")},
+		lastCounters: map[string]disk.IOCountersStat{"loop0": {}},
+		lastRunTime:  time.Now().Add(-time.Second),
+	}
+
+	assert.NoError(t, c.Run())
+	assert.Equal(t, map[string]disk.IOCountersStat{"loop0": loop0}, c.lastCounters)
+}
+
+func mustCompile(t *testing.T, pattern string) *regexp.Regexp {
+	t.Helper()
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		t.Fatalf("invalid test pattern %q: %s", pattern, err)
+	}
+	return re
+}
@@ -8,7 +8,6 @@
 package apiserver
 
 import (
-	"fmt"
 	"time"
 
 	utilcache "github.com/DataDog/datadog-agent/pkg/util/cache"
@@ -16,9 +15,12 @@ import (
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/wait"
 	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
 	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
@@ -31,26 +33,54 @@ const (
 
 // MetadataController is responsible for synchronizing Endpoints objects from the Kubernetes
 // apiserver to build and cache the MetadataMapperBundle for each node.
+// It also watches Pods so that deletions and node reassignments purge stale
+// entries from the bundle immediately, instead of waiting for the
+// metadataMapExpire TTL to evict them.
 // This controller only supports Kubernetes 1.4+.
 type MetadataController struct {
 	nodeLister       corelisters.NodeLister
 	nodeListerSynced cache.InformerSynced
 
-	endpointsLister       corelisters.EndpointsLister
+	// endpointsIndexer backs a metadata-only informer: cached objects hold
+	// only ObjectMeta, not the (potentially large) Subsets payload. reconcileKey
+	// fetches the full object on demand via kubeClient for mapService's subsets.
+	endpointsIndexer      cache.Indexer
 	endpointsListerSynced cache.InformerSynced
 
+	kubeClient kubernetes.Interface
+
+	podLister       corelisters.PodLister
+	podListerSynced cache.InformerSynced
+
+	// collectors is the built-in servicesCollector followed by a snapshot of
+	// whatever was registered via RegisterCollector at construction time.
+	// GetPodMetadataNames iterates this list uniformly; Services aren't a
+	// special case.
+	collectors []MetadataCollector
+
 	// Endpoints that need to be added to services mapping.
 	queue workqueue.RateLimitingInterface
 }
 
-func NewMetadataController(nodeInformer coreinformers.NodeInformer, endpointsInformer coreinformers.EndpointsInformer) *MetadataController {
+// NewMetadataController wires up the controller. endpointsInformer is
+// expected to come from a metadata-only informer factory
+// (k8s.io/client-go/metadata/metadatainformer), so its cache only holds
+// ObjectMeta for Endpoints rather than the full Subsets payload, which can
+// be sizeable on large clusters; kubeClient is used to fetch the full
+// object on demand whenever mapService needs the Subsets.
+func NewMetadataController(nodeInformer coreinformers.NodeInformer, endpointsInformer cache.SharedIndexInformer, kubeClient kubernetes.Interface, podInformer coreinformers.PodInformer) *MetadataController {
 	m := &MetadataController{
-		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "metadata"),
+		queue:      workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "metadata"),
+		kubeClient: kubeClient,
 	}
 	m.nodeLister = nodeInformer.Lister()
 	m.nodeListerSynced = nodeInformer.Informer().HasSynced
 
-	endpointsInformer.Informer().AddEventHandlerWithResyncPeriod(
+	// Defensive pruning transform: if endpointsInformer is ever swapped for a
+	// regular core/v1 Endpoints informer, this still keeps Subsets out of the
+	// cache instead of silently caching the full payload.
+	endpointsInformer.SetTransform(pruneEndpointsSubsets)
+	endpointsInformer.AddEventHandlerWithResyncPeriod(
 		cache.ResourceEventHandlerFuncs{
 			AddFunc:    m.addEndpoints,
 			UpdateFunc: m.updateEndpoints,
@@ -58,8 +88,20 @@ func NewMetadataController(nodeInformer coreinformers.NodeInformer, endpointsInf
 		},
 		metadataMapExpire/2, // delay for re-listing endpoints
 	)
-	m.endpointsLister = endpointsInformer.Lister()
-	m.endpointsListerSynced = endpointsInformer.Informer().HasSynced
+	m.endpointsIndexer = endpointsInformer.GetIndexer()
+	m.endpointsListerSynced = endpointsInformer.HasSynced
+
+	podInformer.Informer().AddEventHandler(
+		cache.ResourceEventHandlerFuncs{
+			AddFunc:    m.addPod,
+			UpdateFunc: m.updatePod,
+			DeleteFunc: m.deletePod,
+		},
+	)
+	m.podLister = podInformer.Lister()
+	m.podListerSynced = podInformer.Informer().HasSynced
+
+	m.collectors = append([]MetadataCollector{servicesCollector{}}, registeredCollectors()...)
 
 	return m
 }
@@ -70,7 +112,7 @@ func (m *MetadataController) Run(stopCh <-chan struct{}) {
 	log.Infof("Starting metadata controller")
 	defer log.Infof("Stopping metadata controller")
 
-	if !cache.WaitForCacheSync(stopCh, m.nodeListerSynced, m.endpointsListerSynced) {
+	if !cache.WaitForCacheSync(stopCh, m.nodeListerSynced, m.endpointsListerSynced, m.podListerSynced) {
 		return
 	}
 
@@ -111,34 +153,139 @@ func (m *MetadataController) processNextWorkItem() bool {
 	return true
 }
 
+// addEndpoints/updateEndpoints/deleteEndpoints only ever see ObjectMeta (the
+// informer caches metadata-only objects), so they use meta.Accessor instead
+// of asserting a concrete *corev1.Endpoints type.
 func (m *MetadataController) addEndpoints(obj interface{}) {
-	endpoints := obj.(*corev1.Endpoints)
-	log.Tracef("Adding endpoints %s", endpoints.Name)
+	if accessor, err := meta.Accessor(obj); err == nil {
+		log.Tracef("Adding endpoints %s", accessor.GetName())
+	}
 	m.enqueue(obj)
 }
 
 func (m *MetadataController) updateEndpoints(_, new interface{}) {
-	newEndpoints := new.(*corev1.Endpoints)
-	log.Tracef("Updating endpoints %s", newEndpoints.Name)
+	if accessor, err := meta.Accessor(new); err == nil {
+		log.Tracef("Updating endpoints %s", accessor.GetName())
+	}
 	m.enqueue(new)
 }
 
 func (m *MetadataController) deleteEndpoints(obj interface{}) {
-	endpoints, ok := obj.(*corev1.Endpoints)
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if accessor, err := meta.Accessor(obj); err == nil {
+		log.Tracef("Deleting endpoints %s", accessor.GetName())
+	}
+	m.enqueue(obj)
+}
+
+// addPod handles a Pod add event. Following the pattern of upstream
+// Kubernetes' endpoints_controller, it resolves the Services backing the pod
+// and enqueues them so the mapping picks up the new pod without waiting for
+// the endpoints resync.
+func (m *MetadataController) addPod(obj interface{}) {
+	pod := obj.(*corev1.Pod)
+	log.Tracef("Adding pod %s/%s", pod.Namespace, pod.Name)
+	m.enqueueServicesForPod(pod)
+}
+
+func (m *MetadataController) updatePod(_, new interface{}) {
+	newPod := new.(*corev1.Pod)
+	log.Tracef("Updating pod %s/%s", newPod.Namespace, newPod.Name)
+	m.enqueueServicesForPod(newPod)
+}
+
+// deletePod handles a Pod delete event. Besides enqueueing the pod's
+// Services for reconciliation, it purges the pod from every cached
+// MetadataMapperBundle right away, so a pod that's rescheduled to a
+// different node doesn't leave a stale node->pod mapping behind until the
+// TTL on the old entry expires.
+func (m *MetadataController) deletePod(obj interface{}) {
+	pod, ok := obj.(*corev1.Pod)
 	if !ok {
 		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
 		if !ok {
 			log.Debugf("Couldn't get object from tombstone %#v", obj)
 			return
 		}
-		endpoints, ok = tombstone.Obj.(*corev1.Endpoints)
+		pod, ok = tombstone.Obj.(*corev1.Pod)
 		if !ok {
-			log.Debugf("Tombstone contained object that is not an endpoint %#v", obj)
+			log.Debugf("Tombstone contained object that is not a pod %#v", obj)
 			return
 		}
 	}
-	log.Tracef("Deleting endpoints %s", endpoints.Name)
-	m.enqueue(obj)
+	log.Tracef("Deleting pod %s/%s", pod.Namespace, pod.Name)
+
+	m.enqueueServicesForPod(pod)
+	m.purgePodFromCache(pod.Namespace, pod.Name)
+}
+
+// enqueueServicesForPod finds the Endpoints objects backing pod and enqueues
+// them for reconciliation. Since the cache only holds ObjectMeta, it has to
+// fetch each candidate's Subsets on demand to check whether it actually
+// references pod.
+func (m *MetadataController) enqueueServicesForPod(pod *corev1.Pod) {
+	objs, err := m.endpointsIndexer.ByIndex(cache.NamespaceIndex, pod.Namespace)
+	if err != nil {
+		log.Debugf("Unable to list endpoints for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		return
+	}
+
+	for _, obj := range objs {
+		accessor, err := meta.Accessor(obj)
+		if err != nil {
+			continue
+		}
+
+		endpoints, err := m.kubeClient.CoreV1().Endpoints(pod.Namespace).Get(accessor.GetName(), metav1.GetOptions{})
+		if err != nil {
+			log.Debugf("Unable to fetch endpoints %s/%s: %v", pod.Namespace, accessor.GetName(), err)
+			continue
+		}
+		if !endpointsReferencePod(endpoints, pod.Name) {
+			continue
+		}
+		m.enqueue(endpoints)
+	}
+}
+
+// endpointsReferencePod returns true if any subset of endpoints targets a
+// pod named podName.
+func endpointsReferencePod(endpoints *corev1.Endpoints, podName string) bool {
+	for _, subset := range endpoints.Subsets {
+		for _, address := range subset.Addresses {
+			if address.TargetRef != nil && address.TargetRef.Kind == "Pod" && address.TargetRef.Name == podName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// purgePodFromCache removes namespace/podName from every cached node
+// bundle.
+func (m *MetadataController) purgePodFromCache(namespace, podName string) {
+	nodes, err := m.nodeLister.List(labels.NewSelector())
+	if err != nil {
+		log.Debugf("Unable to list nodes to purge pod %s/%s from the metadata cache: %v", namespace, podName, err)
+		return
+	}
+
+	for _, node := range nodes {
+		metaBundle, err := getMetadataMapBundle(node.Name)
+		if err != nil {
+			// Nothing cached for this node.
+			continue
+		}
+
+		metaBundle.m.Lock()
+		metaBundle.Services.DeletePod(namespace, podName)
+		metaBundle.m.Unlock()
+
+		cacheKey := utilcache.BuildAgentKey(metadataMapperCachePrefix, node.Name)
+		utilcache.Cache.Set(cacheKey, metaBundle, metadataMapExpire)
+	}
 }
 
 func (m *MetadataController) enqueue(obj interface{}) {
@@ -156,18 +303,45 @@ func (m *MetadataController) reconcileKey(key string) error {
 		return err
 	}
 
-	endpoints, err := m.endpointsLister.Endpoints(namespace).Get(name)
-	switch {
-	case errors.IsNotFound(err):
+	_, found, err := m.endpointsIndexer.GetByKey(key)
+	if err != nil {
+		log.Debugf("Unable to retrieve endpoints %v from store: %v", key, err)
+		return err
+	}
+	if !found {
 		// Endpoints absence in store means watcher caught the deletion, ensure metadata map is cleaned
 		log.Tracef("Endpoints has been deleted %v. Attempting to cleanup metadata map", key)
-		err = m.mapDeletedService(namespace, name)
-	case err != nil:
-		log.Debugf("Unable to retrieve endpoints %v from store: %v", key, err)
-	default:
-		err = m.mapService(endpoints)
+		return m.mapDeletedService(namespace, name)
 	}
-	return err
+
+	// The cache only holds ObjectMeta; fetch the full object on demand for
+	// the Subsets mapService needs.
+	endpoints, err := m.kubeClient.CoreV1().Endpoints(namespace).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		log.Tracef("Endpoints has been deleted %v. Attempting to cleanup metadata map", key)
+		return m.mapDeletedService(namespace, name)
+	}
+	if err != nil {
+		log.Debugf("Unable to retrieve endpoints %v from the apiserver: %v", key, err)
+		return err
+	}
+
+	return m.mapService(endpoints)
+}
+
+// pruneEndpointsSubsets is a cache.TransformFunc that strips the Subsets
+// payload from an Endpoints object before it lands in the informer cache.
+// It's a no-op for objects that are already ObjectMeta-only (the expected
+// case, when endpointsInformer comes from a metadata-only informer
+// factory).
+func pruneEndpointsSubsets(obj interface{}) (interface{}, error) {
+	endpoints, ok := obj.(*corev1.Endpoints)
+	if !ok {
+		return obj, nil
+	}
+	pruned := endpoints.DeepCopy()
+	pruned.Subsets = nil
+	return pruned, nil
 }
 
 func (m *MetadataController) mapService(endpoints *corev1.Endpoints) error {
@@ -247,31 +421,20 @@ func (m *MetadataController) mapDeletedService(namespace, svc string) error {
 	return nil
 }
 
-// GetPodMetadataNames is used when the API endpoint of the DCA to get the metadata of a pod is hit.
-func GetPodMetadataNames(nodeName, ns, podName string) ([]string, error) {
-	var metaList []string
-	cacheKey := utilcache.BuildAgentKey(metadataMapperCachePrefix, nodeName)
-
-	metaBundleInterface, found := utilcache.Cache.Get(cacheKey)
-	if !found {
-		log.Tracef("no metadata was found for the pod %s on node %s", podName, nodeName)
+// GetPodMetadataNames is used when the API endpoint of the DCA to get the
+// metadata of a pod is hit. Services aren't a special case here: they're
+// collected by the built-in servicesCollector, the same way Deployments,
+// Ingresses or any collector registered via RegisterCollector are.
+func (m *MetadataController) GetPodMetadataNames(nodeName, ns, podName string) ([]string, error) {
+	pod, err := m.podLister.Pods(ns).Get(podName)
+	if err != nil {
+		log.Tracef("no cached pod found for %s/%s on node %s: %v", ns, podName, nodeName, err)
 		return nil, nil
 	}
 
-	metaBundle, ok := metaBundleInterface.(*MetadataMapperBundle)
-	if !ok {
-		return nil, fmt.Errorf("invalid cache format for the cacheKey: %s", cacheKey)
-	}
-	// The list of metadata collected in the metaBundle is extensible and is handled here.
-	// If new cluster level tags need to be collected by the agent, only this needs to be modified.
-	serviceList, foundServices := metaBundle.ServicesForPod(ns, podName)
-	if !foundServices {
-		log.Tracef("no cached services list found for the pod %s on the node %s", podName, nodeName)
-		return nil, nil
-	}
-	log.Debugf("CacheKey: %s, with %d services", cacheKey, len(serviceList))
-	for _, s := range serviceList {
-		metaList = append(metaList, fmt.Sprintf("kube_service:%s", s))
+	var metaList []string
+	for _, c := range m.collectors {
+		metaList = append(metaList, c.Collect(pod)...)
 	}
 
 	return metaList, nil
@@ -0,0 +1,66 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package apiserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const fakeEndpointsCount = 5000
+
+func newFakeEndpointsWithSubsets(i int) *v1.Endpoints {
+	return &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("svc-%d", i),
+			Namespace: "default",
+		},
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					newFakeEndpointAddress("node1", newFakePod("default", fmt.Sprintf("pod-%d-a", i), "1111", "1.1.1.1")),
+					newFakeEndpointAddress("node2", newFakePod("default", fmt.Sprintf("pod-%d-b", i), "2222", "2.2.2.2")),
+				},
+			},
+		},
+	}
+}
+
+// BenchmarkEndpointsCacheSize compares the serialized size of 5k Endpoints
+// objects against the ObjectMeta-only view a metadata informer would cache
+// instead, demonstrating the RSS savings pruneEndpointsSubsets/the
+// metadata-only informer are meant to provide.
+func BenchmarkEndpointsCacheSize(b *testing.B) {
+	var fullSize, metaOnlySize int
+
+	for i := 0; i < fakeEndpointsCount; i++ {
+		endpoints := newFakeEndpointsWithSubsets(i)
+
+		fullBytes, err := json.Marshal(endpoints)
+		require.NoError(b, err)
+		fullSize += len(fullBytes)
+
+		pruned, err := pruneEndpointsSubsets(endpoints)
+		require.NoError(b, err)
+		metaOnlyBytes, err := json.Marshal(pruned)
+		require.NoError(b, err)
+		metaOnlySize += len(metaOnlyBytes)
+	}
+
+	b.ReportMetric(float64(fullSize), "full_bytes")
+	b.ReportMetric(float64(metaOnlySize), "meta_only_bytes")
+
+	assert.Less(b, metaOnlySize, fullSize)
+}
@@ -0,0 +1,241 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package apiserver
+
+import (
+	"fmt"
+	"sync"
+
+	utilcache "github.com/DataDog/datadog-agent/pkg/util/cache"
+	"github.com/DataDog/datadog-agent/pkg/util/log"
+
+	corev1 "k8s.io/api/core/v1"
+	extv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	appsinformers "k8s.io/client-go/informers/apps/v1"
+	extinformers "k8s.io/client-go/informers/extensions/v1beta1"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	extlisters "k8s.io/client-go/listers/extensions/v1beta1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// MetadataCollector computes cluster-level tags for a pod. Services are
+// collected by the built-in servicesCollector; downstream code can implement
+// this interface to tag pods by CRDs or objects from other operators (e.g.
+// Argo Rollouts) without editing this package, then call RegisterCollector
+// to have it picked up by the next MetadataController constructed.
+type MetadataCollector interface {
+	// Name identifies the collector, used for logging.
+	Name() string
+	// Informers returns any informers the collector needs watched; the
+	// caller is responsible for starting them and waiting for HasSynced
+	// before NewMetadataController is constructed.
+	Informers() []cache.SharedIndexInformer
+	// Collect returns the tags this collector contributes for pod.
+	Collect(pod *corev1.Pod) []string
+}
+
+var (
+	collectorsMu sync.Mutex
+	collectors   []MetadataCollector
+)
+
+// RegisterCollector adds a MetadataCollector to the set consulted by
+// MetadataController.GetPodMetadataNames. Must be called before
+// NewMetadataController, since the controller only takes a snapshot of the
+// registry at construction time.
+func RegisterCollector(c MetadataCollector) {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	collectors = append(collectors, c)
+}
+
+// registeredCollectors returns a copy of the registered collectors, safe to
+// append to (e.g. to prepend the built-in servicesCollector) without racing
+// a concurrent RegisterCollector call.
+func registeredCollectors() []MetadataCollector {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	out := make([]MetadataCollector, len(collectors))
+	copy(out, collectors)
+	return out
+}
+
+// servicesCollector is the built-in MetadataCollector backing Service
+// tagging. It reads from the MetadataMapperBundle cache that
+// MetadataController's Endpoints watch populates, rather than hardcoding a
+// separate code path in GetPodMetadataNames.
+type servicesCollector struct{}
+
+// Name implements MetadataCollector.
+func (servicesCollector) Name() string {
+	return "services"
+}
+
+// Informers implements MetadataCollector. The Endpoints informer backing
+// this collector's cache is wired up directly by MetadataController, since
+// it also drives reconciliation, not just tagging.
+func (servicesCollector) Informers() []cache.SharedIndexInformer {
+	return nil
+}
+
+// Collect implements MetadataCollector.
+func (servicesCollector) Collect(pod *corev1.Pod) []string {
+	serviceList, found := lookupServicesForPod(pod)
+	if !found {
+		return nil
+	}
+
+	tags := make([]string, 0, len(serviceList))
+	for _, s := range serviceList {
+		tags = append(tags, fmt.Sprintf("kube_service:%s", s))
+	}
+	return tags
+}
+
+// DeploymentCollector tags a pod with the Deployment that owns it, walking
+// OwnerReferences from Pod up to ReplicaSet to Deployment the same way
+// `kubectl rollout` does. Pods whose controller isn't a ReplicaSet, or whose
+// ReplicaSet isn't controlled by a Deployment, get no tag from it.
+type DeploymentCollector struct {
+	rsInformer cache.SharedIndexInformer
+	rsLister   appslisters.ReplicaSetLister
+}
+
+// NewDeploymentCollector returns a DeploymentCollector backed by rsInformer.
+func NewDeploymentCollector(rsInformer appsinformers.ReplicaSetInformer) *DeploymentCollector {
+	return &DeploymentCollector{
+		rsInformer: rsInformer.Informer(),
+		rsLister:   rsInformer.Lister(),
+	}
+}
+
+// Name implements MetadataCollector.
+func (c *DeploymentCollector) Name() string {
+	return "deployment"
+}
+
+// Informers implements MetadataCollector.
+func (c *DeploymentCollector) Informers() []cache.SharedIndexInformer {
+	return []cache.SharedIndexInformer{c.rsInformer}
+}
+
+// Collect implements MetadataCollector.
+func (c *DeploymentCollector) Collect(pod *corev1.Pod) []string {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || owner.Kind != "ReplicaSet" {
+		return nil
+	}
+
+	rs, err := c.rsLister.ReplicaSets(pod.Namespace).Get(owner.Name)
+	if err != nil {
+		log.Debugf("Unable to get ReplicaSet %s/%s owning pod %s: %v", pod.Namespace, owner.Name, pod.Name, err)
+		return nil
+	}
+
+	rsOwner := metav1.GetControllerOf(rs)
+	if rsOwner == nil || rsOwner.Kind != "Deployment" {
+		return nil
+	}
+
+	return []string{fmt.Sprintf("kube_deployment:%s", rsOwner.Name)}
+}
+
+// IngressCollector tags a pod with any Ingress whose backend references one
+// of the Services the pod belongs to.
+type IngressCollector struct {
+	ingressInformer cache.SharedIndexInformer
+	ingressLister   extlisters.IngressLister
+	servicesForPod  func(pod *corev1.Pod) ([]string, bool)
+}
+
+// NewIngressCollector returns an IngressCollector backed by ingressInformer.
+// servicesForPod resolves the Services a pod belongs to; pass
+// lookupServicesForPod to reuse the MetadataController's cached mapping.
+func NewIngressCollector(ingressInformer extinformers.IngressInformer, servicesForPod func(pod *corev1.Pod) ([]string, bool)) *IngressCollector {
+	return &IngressCollector{
+		ingressInformer: ingressInformer.Informer(),
+		ingressLister:   ingressInformer.Lister(),
+		servicesForPod:  servicesForPod,
+	}
+}
+
+// Name implements MetadataCollector.
+func (c *IngressCollector) Name() string {
+	return "ingress"
+}
+
+// Informers implements MetadataCollector.
+func (c *IngressCollector) Informers() []cache.SharedIndexInformer {
+	return []cache.SharedIndexInformer{c.ingressInformer}
+}
+
+// Collect implements MetadataCollector.
+func (c *IngressCollector) Collect(pod *corev1.Pod) []string {
+	services, found := c.servicesForPod(pod)
+	if !found || len(services) == 0 {
+		return nil
+	}
+	serviceSet := make(map[string]struct{}, len(services))
+	for _, s := range services {
+		serviceSet[s] = struct{}{}
+	}
+
+	ingresses, err := c.ingressLister.Ingresses(pod.Namespace).List(labels.Everything())
+	if err != nil {
+		log.Debugf("Unable to list ingresses in namespace %s: %v", pod.Namespace, err)
+		return nil
+	}
+
+	var tags []string
+	for _, ing := range ingresses {
+		if ingressReferencesServices(ing, serviceSet) {
+			tags = append(tags, fmt.Sprintf("kube_ingress:%s", ing.Name))
+		}
+	}
+	return tags
+}
+
+func ingressReferencesServices(ing *extv1beta1.Ingress, services map[string]struct{}) bool {
+	if ing.Spec.Backend != nil {
+		if _, ok := services[ing.Spec.Backend.ServiceName]; ok {
+			return true
+		}
+	}
+	for _, rule := range ing.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			if _, ok := services[path.Backend.ServiceName]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lookupServicesForPod resolves the Services cached for pod via the
+// MetadataMapperBundle for pod's node, for use as an IngressCollector's
+// servicesForPod callback.
+func lookupServicesForPod(pod *corev1.Pod) ([]string, bool) {
+	cacheKey := utilcache.BuildAgentKey(metadataMapperCachePrefix, pod.Spec.NodeName)
+
+	metaBundleInterface, found := utilcache.Cache.Get(cacheKey)
+	if !found {
+		return nil, false
+	}
+
+	metaBundle, ok := metaBundleInterface.(*MetadataMapperBundle)
+	if !ok {
+		return nil, false
+	}
+
+	return metaBundle.ServicesForPod(pod.Namespace, pod.Name)
+}
@@ -0,0 +1,72 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License Version 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2018 Datadog, Inc.
+
+// +build kubeapiserver
+
+package apiserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	utilcache "github.com/DataDog/datadog-agent/pkg/util/cache"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestMetadataControllerPodDeleteRemovesStaleMapping(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}})
+	informerFactory := informers.NewSharedInformerFactory(client, 0*time.Second)
+
+	metaController := NewMetadataController(
+		informerFactory.Core().V1().Nodes(),
+		informerFactory.Core().V1().Endpoints().Informer(),
+		client,
+		informerFactory.Core().V1().Pods(),
+	)
+	metaController.endpointsListerSynced = alwaysReady
+	metaController.podListerSynced = alwaysReady
+
+	stop := make(chan struct{})
+	defer close(stop)
+	informerFactory.Start(stop)
+	require.True(t, cache.WaitForCacheSync(stop, metaController.nodeListerSynced))
+
+	pod := newFakePod("foo", "pod1_name", "1111", "1.1.1.1")
+
+	endpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "svc1", Namespace: "foo"},
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					newFakeEndpointAddress("node1", pod),
+				},
+			},
+		},
+	}
+
+	require.NoError(t, metaController.mapService(endpoints))
+
+	cacheKey := utilcache.BuildAgentKey(metadataMapperCachePrefix, "node1")
+	v, ok := utilcache.Cache.Get(cacheKey)
+	require.True(t, ok)
+	metaBundle := v.(*MetadataMapperBundle)
+	assert.Equal(t, sets.NewString("svc1"), metaBundle.Services["foo"]["pod1_name"])
+
+	metaController.deletePod(pod)
+
+	v, ok = utilcache.Cache.Get(cacheKey)
+	require.True(t, ok)
+	metaBundle = v.(*MetadataMapperBundle)
+	assert.Empty(t, metaBundle.Services["foo"]["pod1_name"])
+}
@@ -120,7 +120,7 @@ func TestMetadataControllerMapServices(t *testing.T) {
 	}
 	for _, tt := range tests {
 		for _, endpoints := range tt.endpoints {
-			err := metaController.mapServices(endpoints)
+			err := metaController.mapService(endpoints)
 			require.NoError(t, err)
 		}
 
@@ -141,9 +141,12 @@ func newFakeMetadataController(client kubernetes.Interface) (*MetadataController
 
 	metaController := NewMetadataController(
 		informerFactory.Core().V1().Nodes(),
-		informerFactory.Core().V1().Endpoints(),
+		informerFactory.Core().V1().Endpoints().Informer(),
+		client,
+		informerFactory.Core().V1().Pods(),
 	)
 	metaController.endpointsListerSynced = alwaysReady
+	metaController.podListerSynced = alwaysReady
 
 	return metaController, informerFactory
 }